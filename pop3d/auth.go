@@ -0,0 +1,71 @@
+package pop3d
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Authenticator verifies a POP3 USER/PASS pair, keyed by mailbox local-part
+// so it composes with the hashed mailbox directory layout used elsewhere in
+// this project.
+type Authenticator interface {
+	Authenticate(user, pass string) (bool, error)
+}
+
+// StaticAuthenticator authenticates against a fixed in-memory user/password
+// map. It's intended for tests and small fixed-credential deployments.
+type StaticAuthenticator map[string]string
+
+// Authenticate implements Authenticator.
+func (a StaticAuthenticator) Authenticate(user, pass string) (bool, error) {
+	want, ok := a[user]
+	if !ok {
+		return false, nil
+	}
+	return want == pass, nil
+}
+
+// HtpasswdAuthenticator authenticates against an Apache htpasswd file,
+// re-read on every call so credential changes take effect without
+// restarting the server. Only the "{SHA}" password format is supported.
+type HtpasswdAuthenticator struct {
+	Path string
+}
+
+// Authenticate implements Authenticator.
+func (a *HtpasswdAuthenticator) Authenticate(user, pass string) (bool, error) {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return false, fmt.Errorf("pop3d: opening htpasswd file: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] != user {
+			continue
+		}
+		return checkShaPassword(parts[1], pass), nil
+	}
+	return false, scanner.Err()
+}
+
+// checkShaPassword compares pass against an Apache htpasswd "{SHA}" entry,
+// which stores base64(sha1(password)).
+func checkShaPassword(hash, pass string) bool {
+	const prefix = "{SHA}"
+	if !strings.HasPrefix(hash, prefix) {
+		return false
+	}
+	sum := sha1.Sum([]byte(pass))
+	return base64.StdEncoding.EncodeToString(sum[:]) == strings.TrimPrefix(hash, prefix)
+}
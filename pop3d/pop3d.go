@@ -0,0 +1,93 @@
+// Package pop3d implements a POP3 (RFC 1939) retrieval server that serves
+// messages out of an existing mail store. It depends only on the small
+// interfaces declared below rather than importing the smtpd package
+// directly; smtpd's FileDataStore, FileMailbox and FileMessage satisfy them
+// structurally.
+package pop3d
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// DataStore resolves a POP3 user's local-part to their mailbox.
+type DataStore interface {
+	MailboxFor(name string) (Mailbox, error)
+}
+
+// Mailbox is the subset of smtpd.Mailbox a POP3 session needs. Lock/Unlock
+// give a session exclusive access from a successful PASS until QUIT, as
+// required by RFC 1939 section 3: once a session has taken a message
+// snapshot, sequence numbers in that snapshot must stay valid until QUIT.
+type Mailbox interface {
+	Lock() error
+	Unlock()
+	GetMessages() ([]Message, error)
+}
+
+// Message is the subset of smtpd.Message a POP3 session needs to answer
+// LIST/UIDL/RETR/TOP and to commit a DELE on QUIT.
+type Message interface {
+	ID() string
+	Size() int
+	ReadRaw() (io.ReadCloser, error)
+	Delete() error
+}
+
+// Config configures a Server.
+type Config struct {
+	Addr   string // listen address, e.g. "0.0.0.0:1100"
+	Domain string // used in session greetings and error text
+}
+
+// Server accepts POP3 connections and serves each on its own goroutine.
+type Server struct {
+	cfg      Config
+	ds       DataStore
+	auth     Authenticator
+	listener net.Listener
+}
+
+// NewServer returns a Server that will authenticate against auth and serve
+// mailboxes out of ds once started.
+func NewServer(cfg Config, ds DataStore, auth Authenticator) *Server {
+	return &Server{cfg: cfg, ds: ds, auth: auth}
+}
+
+// Start opens the listening socket and begins accepting connections in the
+// background.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("pop3d: listen on %v: %v", s.cfg.Addr, err)
+	}
+	s.listener = l
+	go s.serve()
+	return nil
+}
+
+// Stop closes the listening socket. Sessions already in progress are left
+// to finish on their own.
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// Listener was closed by Stop.
+			return
+		}
+		go NewSession(conn, s.cfg, s.ds, s.auth).Serve()
+	}
+}
+
+func logf(format string, args ...interface{}) {
+	log.Printf("pop3d: "+format, args...)
+}
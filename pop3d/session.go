@@ -0,0 +1,405 @@
+package pop3d
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// state is the POP3 session state machine position, per RFC 1939 section 3.
+type state int
+
+const (
+	stateAuthorization state = iota
+	stateTransaction
+	stateUpdate
+)
+
+// Session handles a single POP3 client connection from greeting through
+// QUIT.
+type Session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	cfg  Config
+	ds   DataStore
+	auth Authenticator
+
+	state   state
+	user    string
+	mailbox Mailbox
+
+	// msgs is the message snapshot taken once PASS succeeds; its order and
+	// contents are fixed for the rest of the session regardless of new
+	// deliveries, per RFC 1939 section 3.
+	msgs []Message
+
+	// deleted holds the indexes (into msgs) marked by DELE this session.
+	// RSET clears it and QUIT commits it by calling Message.Delete.
+	deleted map[int]bool
+
+	// mailboxLocked is true while this session holds mailbox's process
+	// local lock, taken in cmdPass and released by unlockMailbox. Serve
+	// defers unlockMailbox so an abnormal disconnect after PASS can't
+	// leak the lock.
+	mailboxLocked bool
+}
+
+// NewSession wraps conn in a Session ready to Serve.
+func NewSession(conn net.Conn, cfg Config, ds DataStore, auth Authenticator) *Session {
+	return &Session{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		cfg:     cfg,
+		ds:      ds,
+		auth:    auth,
+		state:   stateAuthorization,
+		deleted: make(map[int]bool),
+	}
+}
+
+// Serve drives the session to completion. It always closes conn before
+// returning.
+func (s *Session) Serve() {
+	defer s.conn.Close()
+	defer s.unlockMailbox()
+	s.respondf("+OK %s POP3 server ready", s.cfg.Domain)
+
+	for s.state != stateUpdate {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if err := s.dispatch(strings.TrimRight(line, "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Session) dispatch(line string) error {
+	verb, arg := splitCommand(line)
+	switch strings.ToUpper(verb) {
+	case "USER":
+		return s.cmdUser(arg)
+	case "PASS":
+		return s.cmdPass(arg)
+	case "STAT":
+		return s.cmdStat()
+	case "LIST":
+		return s.cmdList(arg)
+	case "UIDL":
+		return s.cmdUidl(arg)
+	case "RETR":
+		return s.cmdRetr(arg)
+	case "TOP":
+		return s.cmdTop(arg)
+	case "DELE":
+		return s.cmdDele(arg)
+	case "RSET":
+		return s.cmdRset()
+	case "NOOP":
+		return s.respondf("+OK")
+	case "QUIT":
+		return s.cmdQuit()
+	default:
+		return s.respondf("-ERR unknown command %q", verb)
+	}
+}
+
+func splitCommand(line string) (verb, arg string) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(parts) == 2 {
+		return parts[0], strings.TrimSpace(parts[1])
+	}
+	return parts[0], ""
+}
+
+func (s *Session) cmdUser(arg string) error {
+	if s.state != stateAuthorization {
+		return s.respondf("-ERR USER not allowed in this state")
+	}
+	if arg == "" {
+		return s.respondf("-ERR USER requires a name")
+	}
+	s.user = arg
+	return s.respondf("+OK")
+}
+
+func (s *Session) cmdPass(pass string) error {
+	if s.state != stateAuthorization || s.user == "" {
+		return s.respondf("-ERR USER must precede PASS")
+	}
+
+	ok, err := s.auth.Authenticate(s.user, pass)
+	if err != nil {
+		logf("authenticating %q: %v", s.user, err)
+		return s.respondf("-ERR authentication failed")
+	}
+	if !ok {
+		return s.respondf("-ERR authentication failed")
+	}
+
+	mb, err := s.ds.MailboxFor(s.user)
+	if err != nil {
+		logf("resolving mailbox for %q: %v", s.user, err)
+		return s.respondf("-ERR authentication failed")
+	}
+	if err := mb.Lock(); err != nil {
+		return s.respondf("-ERR %v", err)
+	}
+	s.mailbox = mb
+	s.mailboxLocked = true
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		s.unlockMailbox()
+		logf("listing messages for %q: %v", s.user, err)
+		return s.respondf("-ERR unable to open mailbox")
+	}
+
+	s.msgs = msgs
+	s.state = stateTransaction
+	return s.respondf("+OK %s's maildrop has %d message(s)", s.user, len(s.msgs))
+}
+
+// unlockMailbox releases the session's hold on s.mailbox, if any. It's
+// safe to call more than once or before a mailbox was ever locked.
+func (s *Session) unlockMailbox() {
+	if !s.mailboxLocked {
+		return
+	}
+	s.mailbox.Unlock()
+	s.mailboxLocked = false
+}
+
+// resolve validates a 1-based message number from a LIST/RETR/TOP/DELE
+// argument against the session snapshot, rejecting already-deleted
+// messages.
+func (s *Session) resolve(arg string) (index int, err error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.msgs) {
+		return 0, fmt.Errorf("no such message")
+	}
+	index = n - 1
+	if s.deleted[index] {
+		return 0, fmt.Errorf("message %d already deleted", n)
+	}
+	return index, nil
+}
+
+func (s *Session) requireTransaction() bool {
+	return s.state == stateTransaction
+}
+
+func (s *Session) cmdStat() error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR STAT not allowed in this state")
+	}
+	count, size := 0, 0
+	for i, m := range s.msgs {
+		if s.deleted[i] {
+			continue
+		}
+		count++
+		size += m.Size()
+	}
+	return s.respondf("+OK %d %d", count, size)
+}
+
+func (s *Session) cmdList(arg string) error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR LIST not allowed in this state")
+	}
+	if arg != "" {
+		i, err := s.resolve(arg)
+		if err != nil {
+			return s.respondf("-ERR %v", err)
+		}
+		return s.respondf("+OK %d %d", i+1, s.msgs[i].Size())
+	}
+
+	if err := s.respondf("+OK scan listing follows"); err != nil {
+		return err
+	}
+	for i, m := range s.msgs {
+		if s.deleted[i] {
+			continue
+		}
+		if _, err := fmt.Fprintf(s.writer, "%d %d\r\n", i+1, m.Size()); err != nil {
+			return err
+		}
+	}
+	return s.endMultiline()
+}
+
+func (s *Session) cmdUidl(arg string) error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR UIDL not allowed in this state")
+	}
+	if arg != "" {
+		i, err := s.resolve(arg)
+		if err != nil {
+			return s.respondf("-ERR %v", err)
+		}
+		return s.respondf("+OK %d %s", i+1, s.msgs[i].ID())
+	}
+
+	if err := s.respondf("+OK unique-id listing follows"); err != nil {
+		return err
+	}
+	for i, m := range s.msgs {
+		if s.deleted[i] {
+			continue
+		}
+		if _, err := fmt.Fprintf(s.writer, "%d %s\r\n", i+1, m.ID()); err != nil {
+			return err
+		}
+	}
+	return s.endMultiline()
+}
+
+func (s *Session) cmdRetr(arg string) error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR RETR not allowed in this state")
+	}
+	i, err := s.resolve(arg)
+	if err != nil {
+		return s.respondf("-ERR %v", err)
+	}
+	r, err := s.msgs[i].ReadRaw()
+	if err != nil {
+		logf("reading message: %v", err)
+		return s.respondf("-ERR unable to read message")
+	}
+	defer r.Close()
+
+	if err := s.respondf("+OK %d octets", s.msgs[i].Size()); err != nil {
+		return err
+	}
+	return s.writeDotStuffed(r, -1)
+}
+
+func (s *Session) cmdTop(arg string) error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR TOP not allowed in this state")
+	}
+	parts := strings.SplitN(arg, " ", 2)
+	if len(parts) != 2 {
+		return s.respondf("-ERR TOP requires a message number and line count")
+	}
+	i, err := s.resolve(parts[0])
+	if err != nil {
+		return s.respondf("-ERR %v", err)
+	}
+	lines, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || lines < 0 {
+		return s.respondf("-ERR invalid line count")
+	}
+
+	r, err := s.msgs[i].ReadRaw()
+	if err != nil {
+		logf("reading message: %v", err)
+		return s.respondf("-ERR unable to read message")
+	}
+	defer r.Close()
+
+	if err := s.respondf("+OK"); err != nil {
+		return err
+	}
+	return s.writeDotStuffed(r, lines)
+}
+
+func (s *Session) cmdDele(arg string) error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR DELE not allowed in this state")
+	}
+	i, err := s.resolve(arg)
+	if err != nil {
+		return s.respondf("-ERR %v", err)
+	}
+	s.deleted[i] = true
+	return s.respondf("+OK message %s deleted", arg)
+}
+
+func (s *Session) cmdRset() error {
+	if !s.requireTransaction() {
+		return s.respondf("-ERR RSET not allowed in this state")
+	}
+	s.deleted = make(map[int]bool)
+	return s.respondf("+OK")
+}
+
+func (s *Session) cmdQuit() error {
+	if s.state != stateTransaction {
+		s.respondf("+OK %s signing off", s.cfg.Domain)
+		s.state = stateUpdate
+		return nil
+	}
+
+	for i, deleted := range s.deleted {
+		if !deleted {
+			continue
+		}
+		if err := s.msgs[i].Delete(); err != nil {
+			logf("deleting message %s during QUIT: %v", s.msgs[i].ID(), err)
+		}
+	}
+	s.unlockMailbox()
+	s.state = stateUpdate
+	return s.respondf("+OK %s signing off", s.cfg.Domain)
+}
+
+// writeDotStuffed copies r to the client as a POP3 multi-line response body:
+// lines beginning with "." are escaped with a leading extra ".", and the
+// terminating ".\r\n" is appended once the full message (or, if maxLines is
+// non-negative, its headers plus maxLines body lines) has been sent.
+func (s *Session) writeDotStuffed(r io.Reader, maxLines int) error {
+	br := bufio.NewReader(r)
+	inBody := false
+	bodyLines := 0
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if inBody && maxLines >= 0 && bodyLines >= maxLines {
+				break
+			}
+			if strings.HasPrefix(line, ".") {
+				line = "." + line
+			}
+			if !strings.HasSuffix(line, "\n") {
+				line += "\r\n"
+			}
+			if _, werr := io.WriteString(s.writer, line); werr != nil {
+				return werr
+			}
+			if inBody {
+				bodyLines++
+			}
+			if strings.TrimRight(line, "\r\n") == "" {
+				inBody = true
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return s.endMultiline()
+}
+
+func (s *Session) endMultiline() error {
+	if _, err := s.writer.WriteString(".\r\n"); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+func (s *Session) respondf(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.writer, format+"\r\n", args...); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
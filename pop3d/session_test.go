@@ -0,0 +1,218 @@
+package pop3d
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memMessage is a minimal in-memory Message, standing in for
+// smtpd.FileMessage so this package's tests don't need to import smtpd.
+type memMessage struct {
+	id      string
+	body    []byte
+	deleted bool
+}
+
+func (m *memMessage) ID() string { return m.id }
+func (m *memMessage) Size() int  { return len(m.body) }
+func (m *memMessage) ReadRaw() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(m.body)), nil
+}
+func (m *memMessage) Delete() error {
+	m.deleted = true
+	return nil
+}
+
+// memMailbox is a minimal in-memory Mailbox, standing in for
+// smtpd.FileMailbox.
+type memMailbox struct {
+	locked bool
+	msgs   []*memMessage
+}
+
+func (mb *memMailbox) Lock() error {
+	if mb.locked {
+		return fmt.Errorf("mailbox is locked by another session")
+	}
+	mb.locked = true
+	return nil
+}
+
+func (mb *memMailbox) Unlock() { mb.locked = false }
+
+func (mb *memMailbox) GetMessages() ([]Message, error) {
+	var out []Message
+	for _, m := range mb.msgs {
+		if !m.deleted {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// deliverMessage appends a message to mb, mirroring smtpd's own
+// deliverMessage test helper closely enough to exercise the same RETR/TOP
+// body shape.
+func deliverMessage(mb *memMailbox, subject string) (id string, size int) {
+	id = fmt.Sprintf("msg%d", len(mb.msgs)+1)
+	body := []byte("To: somebody@host\r\n" +
+		"From: somebodyelse@host\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" +
+		"Test Body\r\n")
+	mb.msgs = append(mb.msgs, &memMessage{id: id, body: body})
+	return id, len(body)
+}
+
+type memDataStore struct {
+	mailboxes map[string]*memMailbox
+}
+
+func (ds *memDataStore) MailboxFor(name string) (Mailbox, error) {
+	mb, ok := ds.mailboxes[name]
+	if !ok {
+		return nil, fmt.Errorf("no such mailbox %q", name)
+	}
+	return mb, nil
+}
+
+// TestSessionLifecycle drives a Session over a net.Pipe through the full
+// AUTHORIZATION -> TRANSACTION -> UPDATE lifecycle: login, list/retrieve a
+// delivered message, delete and undelete it with RSET, then delete and
+// commit on QUIT. It also confirms the message snapshot taken at PASS time
+// doesn't see a delivery that happens mid-session.
+func TestSessionLifecycle(t *testing.T) {
+	mb := &memMailbox{}
+	id1, size1 := deliverMessage(mb, "hello")
+	ds := &memDataStore{mailboxes: map[string]*memMailbox{"james": mb}}
+	auth := StaticAuthenticator{"james": "secret"}
+	cfg := Config{Domain: "test.inbucket"}
+
+	client, server := net.Pipe()
+	go NewSession(server, cfg, ds, auth).Serve()
+	r := newTestReader(client)
+	defer client.Close()
+
+	r.expect(t, "+OK")
+
+	// RETR before login is rejected.
+	r.send(t, "RETR 1")
+	r.expect(t, "-ERR")
+
+	r.send(t, "USER james")
+	r.expect(t, "+OK")
+	r.send(t, "PASS wrong")
+	r.expect(t, "-ERR")
+
+	r.send(t, "USER james")
+	r.expect(t, "+OK")
+	r.send(t, "PASS secret")
+	r.expect(t, "+OK")
+
+	// A message delivered after the snapshot must not appear this session.
+	deliverMessage(mb, "late arrival")
+
+	r.send(t, "STAT")
+	assert.Equal(t, fmt.Sprintf("+OK 1 %d", size1), r.expect(t, "+OK"))
+
+	r.send(t, "LIST")
+	r.expect(t, "+OK")
+	assert.Equal(t, fmt.Sprintf("%d %d", 1, size1), r.readLine(t))
+	assert.Equal(t, ".", r.readLine(t))
+
+	r.send(t, "UIDL 1")
+	assert.Equal(t, fmt.Sprintf("+OK 1 %s", id1), r.expect(t, "+OK"))
+
+	r.send(t, "RETR 1")
+	r.expect(t, fmt.Sprintf("+OK %d octets", size1))
+	body := r.readUntilDot(t)
+	assert.Contains(t, body, "Subject: hello")
+
+	r.send(t, "TOP 1 0")
+	r.expect(t, "+OK")
+	headers := r.readUntilDot(t)
+	assert.Contains(t, headers, "Subject: hello")
+	assert.NotContains(t, headers, "Test Body")
+
+	r.send(t, "DELE 1")
+	r.expect(t, "+OK")
+
+	// Deleted messages drop out of LIST/STAT immediately...
+	r.send(t, "STAT")
+	assert.Equal(t, "+OK 0 0", r.expect(t, "+OK"))
+
+	// ...but RSET brings them back, and nothing is actually removed yet.
+	r.send(t, "RSET")
+	r.expect(t, "+OK")
+	r.send(t, "STAT")
+	assert.Equal(t, fmt.Sprintf("+OK 1 %d", size1), r.expect(t, "+OK"))
+	assert.False(t, mb.msgs[0].deleted)
+
+	r.send(t, "DELE 1")
+	r.expect(t, "+OK")
+	r.send(t, "QUIT")
+	r.expect(t, "+OK")
+
+	// Deletion only commits on clean QUIT.
+	assert.True(t, mb.msgs[0].deleted)
+	assert.False(t, mb.locked)
+}
+
+// testReader is a minimal line-oriented client used to drive a Session over
+// a net.Pipe in tests.
+type testReader struct {
+	conn net.Conn
+}
+
+func newTestReader(conn net.Conn) *testReader {
+	return &testReader{conn: conn}
+}
+
+func (r *testReader) send(t *testing.T, line string) {
+	if _, err := r.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatalf("writing %q: %v", line, err)
+	}
+}
+
+func (r *testReader) readLine(t *testing.T) string {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		if buf[0] == '\n' {
+			return string(bytes.TrimRight(line, "\r"))
+		}
+		line = append(line, buf[0])
+	}
+}
+
+func (r *testReader) expect(t *testing.T, prefix string) string {
+	line := r.readLine(t)
+	assert.True(t, len(line) >= len(prefix) && line[:len(prefix)] == prefix,
+		"expected response starting with %q, got %q", prefix, line)
+	return line
+}
+
+func (r *testReader) readUntilDot(t *testing.T) string {
+	var out bytes.Buffer
+	for {
+		line := r.readLine(t)
+		if line == "." {
+			return out.String()
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+}
@@ -0,0 +1,89 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/vangual/inbucket/pop3d"
+)
+
+// NewConfiguredDataStore constructs the DataStore backend named by kind,
+// which is expected to come from an operator's "datastore" config setting.
+// "file" (also the zero value) selects the hashed-directory FileDataStore;
+// "maildir" selects MaildirDataStore.
+func NewConfiguredDataStore(kind, path string) (DataStore, error) {
+	switch kind {
+	case "", "file":
+		return NewFileDataStore(path), nil
+	case "maildir":
+		return NewMaildirDataStore(path), nil
+	default:
+		return nil, fmt.Errorf("smtpd: unknown datastore kind %q", kind)
+	}
+}
+
+// POP3Config holds the operator-facing settings for enabling POP3
+// retrieval alongside SMTP delivery, meant to live next to the existing
+// "datastore"-style fields on whatever struct main flags are parsed into.
+type POP3Config struct {
+	Enabled  bool
+	Addr     string // listen address, e.g. "0.0.0.0:1100"
+	Domain   string // used in session greetings and error text
+	Htpasswd string // path to an Apache htpasswd file ("{SHA}" entries only)
+}
+
+// NewConfiguredPOP3Server builds a pop3d.Server authenticating against
+// cfg.Htpasswd and serving out of ds, or returns (nil, nil) if cfg.Enabled
+// is false. The caller is responsible for calling Start/Stop on the
+// result, the same as it would for the SMTP listener.
+//
+// ds must be the same *FileDataStore passed to the SMTP server; there is
+// no POP3 adapter for MaildirDataStore yet; see NewPOP3DataStore.
+func NewConfiguredPOP3Server(cfg POP3Config, ds *FileDataStore) (*pop3d.Server, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Htpasswd == "" {
+		return nil, fmt.Errorf("smtpd: pop3 enabled but no htpasswd file configured")
+	}
+	auth := &pop3d.HtpasswdAuthenticator{Path: cfg.Htpasswd}
+	server := pop3d.NewServer(pop3d.Config{Addr: cfg.Addr, Domain: cfg.Domain}, NewPOP3DataStore(ds), auth)
+	return server, nil
+}
+
+// NewConfiguredReaper builds a Reaper over ds for reclaiming expired
+// Poll leases in the background. Unlike NewConfiguredPOP3Server this has
+// no enable flag: a Reaper is cheap to run and the at-least-once delivery
+// semantics in queue.go depend on one running wherever Poll/Ack/Nack are
+// used, so main should always start one alongside the SMTP and POP3
+// listeners. The caller is responsible for calling Start/Stop on the
+// result, the same as it would for those listeners.
+func NewConfiguredReaper(ds *FileDataStore) *Reaper {
+	return NewReaper(ds)
+}
+
+// ImportMailboxMbox reads r as an mbox stream (see FileMailbox.ImportMbox)
+// and delivers its messages into the named mailbox of ds, returning how
+// many were imported. This is the single entry point a CLI "import"
+// subcommand or an HTTP upload handler should call: ExportMbox/ImportMbox
+// are FileMailbox methods, so callers holding only the DataStore/Mailbox
+// interfaces from datastore.go have no way to reach them without this.
+func ImportMailboxMbox(ds *FileDataStore, mailboxName string, r io.Reader) (int, error) {
+	mb, err := ds.MailboxFor(mailboxName)
+	if err != nil {
+		return 0, fmt.Errorf("smtpd: importing into %v: %v", mailboxName, err)
+	}
+	return mb.(*FileMailbox).ImportMbox(r)
+}
+
+// ExportMailboxMbox writes the named mailbox of ds to w as an mbox stream
+// (see FileMailbox.ExportMbox). This is the entry point a CLI "export"
+// subcommand or an HTTP download handler should call; see
+// ImportMailboxMbox for why one is needed.
+func ExportMailboxMbox(ds *FileDataStore, mailboxName string, w io.Writer) error {
+	mb, err := ds.MailboxFor(mailboxName)
+	if err != nil {
+		return fmt.Errorf("smtpd: exporting %v: %v", mailboxName, err)
+	}
+	return mb.(*FileMailbox).ExportMbox(w)
+}
@@ -0,0 +1,40 @@
+package smtpd
+
+// DataStore represents a storage backend for mailboxes. FileDataStore and
+// MaildirDataStore are the two implementations; both store the same logical
+// content (messages grouped into per-recipient mailboxes) but lay it out on
+// disk very differently, so callers should depend on this interface rather
+// than a concrete type wherever possible.
+type DataStore interface {
+	// AllMailboxes returns every mailbox currently present in the store.
+	AllMailboxes() ([]Mailbox, error)
+	// MailboxFor returns the mailbox for the given email address or local
+	// part. MaildirDataStore creates the mailbox's on-disk structure here;
+	// FileDataStore defers that to the first delivery. It does not
+	// guarantee any messages exist yet.
+	MailboxFor(name string) (Mailbox, error)
+}
+
+// Mailbox represents a single recipient's collection of messages.
+type Mailbox interface {
+	// GetMessages returns every message in the mailbox, ordered oldest
+	// first.
+	GetMessages() ([]Message, error)
+	// GetMessage returns a single message by ID.
+	GetMessage(id string) (Message, error)
+	// Purge removes every message from the mailbox.
+	Purge() error
+}
+
+// Message represents a single stored message.
+type Message interface {
+	ID() string
+	Size() int
+	Subject() string
+	Delete() error
+	// Append writes data to the message being delivered. It may be called
+	// multiple times before Close.
+	Append(data []byte) error
+	// Close finalizes delivery, making the message visible to readers.
+	Close() error
+}
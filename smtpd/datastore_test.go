@@ -0,0 +1,203 @@
+package smtpd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dsBackend describes one DataStore implementation under test, plus a way
+// to deliver a message to it without going through the SMTP session code.
+type dsBackend struct {
+	name     string
+	newStore func(path string) DataStore
+	deliver  func(ds DataStore, mbName, subject string, date time.Time) (id string, size int)
+}
+
+var dsBackends = []dsBackend{
+	{
+		name:     "FileDataStore",
+		newStore: func(path string) DataStore { return NewFileDataStore(path) },
+		deliver: func(ds DataStore, mbName, subject string, date time.Time) (string, int) {
+			return deliverMessage(ds.(*FileDataStore), mbName, subject, date)
+		},
+	},
+	{
+		name:     "MaildirDataStore",
+		newStore: func(path string) DataStore { return NewMaildirDataStore(path) },
+		deliver:  deliverMaildirMessage,
+	},
+}
+
+func deliverMaildirMessage(ds DataStore, mbName, subject string, date time.Time) (id string, size int) {
+	raw := []byte("To: somebody@host\r\n" +
+		"From: somebodyelse@host\r\n" +
+		fmt.Sprintf("Subject: %s\r\n", subject) +
+		"\r\n" +
+		"Test Body\r\n")
+
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		panic(err)
+	}
+	msg, err := mb.(*MaildirMailbox).NewMessage()
+	if err != nil {
+		panic(err)
+	}
+	if err := msg.Append(raw); err != nil {
+		panic(err)
+	}
+	if err := msg.Close(); err != nil {
+		panic(err)
+	}
+	return msg.ID(), len(raw)
+}
+
+// TestDataStoreDeliverOrder verifies that both DataStore backends return
+// messages in delivery order, including when the mailbox is re-opened
+// between deliveries.
+func TestDataStoreDeliverOrder(t *testing.T) {
+	for _, b := range dsBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "inbucket")
+			assert.Nil(t, err)
+			defer os.RemoveAll(path)
+			ds := b.newStore(path)
+
+			subjects := []string{"alpha", "bravo", "charlie"}
+			for _, subj := range subjects {
+				b.deliver(ds, "fred", subj, time.Now())
+			}
+
+			mb, err := ds.MailboxFor("fred")
+			assert.Nil(t, err)
+			msgs, err := mb.GetMessages()
+			assert.Nil(t, err)
+			assert.Equal(t, len(subjects), len(msgs))
+			for i, expect := range subjects {
+				assert.Equal(t, expect, msgs[i].Subject())
+			}
+		})
+	}
+}
+
+// TestDataStoreDelete verifies delete semantics match across backends: a
+// deleted message disappears from GetMessages while the rest keep their
+// relative order.
+func TestDataStoreDelete(t *testing.T) {
+	for _, b := range dsBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "inbucket")
+			assert.Nil(t, err)
+			defer os.RemoveAll(path)
+			ds := b.newStore(path)
+
+			subjects := []string{"alpha", "bravo", "charlie"}
+			for _, subj := range subjects {
+				b.deliver(ds, "fred", subj, time.Now())
+			}
+
+			mb, err := ds.MailboxFor("fred")
+			assert.Nil(t, err)
+			msgs, err := mb.GetMessages()
+			assert.Nil(t, err)
+			assert.Nil(t, msgs[1].Delete())
+
+			mb, err = ds.MailboxFor("fred")
+			assert.Nil(t, err)
+			msgs, err = mb.GetMessages()
+			assert.Nil(t, err)
+
+			remaining := []string{"alpha", "charlie"}
+			assert.Equal(t, len(remaining), len(msgs))
+			for i, expect := range remaining {
+				assert.Equal(t, expect, msgs[i].Subject())
+			}
+		})
+	}
+}
+
+// TestDataStoreAllMailboxes verifies both backends' AllMailboxes finds
+// every mailbox that has received mail, and only those.
+func TestDataStoreAllMailboxes(t *testing.T) {
+	for _, b := range dsBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "inbucket")
+			assert.Nil(t, err)
+			defer os.RemoveAll(path)
+			ds := b.newStore(path)
+
+			names := []string{"fred", "wilma"}
+			for _, name := range names {
+				b.deliver(ds, name, "alpha", time.Now())
+			}
+
+			mailboxes, err := ds.AllMailboxes()
+			assert.Nil(t, err)
+			assert.Equal(t, len(names), len(mailboxes))
+		})
+	}
+}
+
+// TestDataStorePurge verifies both backends' Purge empties a mailbox
+// without disturbing others.
+func TestDataStorePurge(t *testing.T) {
+	for _, b := range dsBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "inbucket")
+			assert.Nil(t, err)
+			defer os.RemoveAll(path)
+			ds := b.newStore(path)
+
+			subjects := []string{"alpha", "bravo", "charlie"}
+			for _, subj := range subjects {
+				b.deliver(ds, "fred", subj, time.Now())
+			}
+			b.deliver(ds, "wilma", "untouched", time.Now())
+
+			mb, err := ds.MailboxFor("fred")
+			assert.Nil(t, err)
+			assert.Nil(t, mb.Purge())
+
+			msgs, err := mb.GetMessages()
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(msgs))
+
+			other, err := ds.MailboxFor("wilma")
+			assert.Nil(t, err)
+			msgs, err = other.GetMessages()
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(msgs))
+		})
+	}
+}
+
+// TestDataStoreSize verifies both backends report the same size as the raw
+// bytes delivered.
+func TestDataStoreSize(t *testing.T) {
+	for _, b := range dsBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "inbucket")
+			assert.Nil(t, err)
+			defer os.RemoveAll(path)
+			ds := b.newStore(path)
+
+			id, size := b.deliver(ds, "fred", "much longer than the others", time.Now())
+
+			mb, err := ds.MailboxFor("fred")
+			assert.Nil(t, err)
+			msg, err := mb.GetMessage(id)
+			assert.Nil(t, err)
+			assert.Equal(t, size, msg.Size())
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FileDataStore implements DataStore using a hashed-directory layout: a
+// mailbox's messages live under mail/h[:3]/h[:6]/h, where h is the hex
+// SHA1 of the mailbox name, with an index.gob file listing the mailbox's
+// messages in delivery order alongside each message's raw RFC822 content
+// as "<id>.raw". The hashing keeps any one directory from accumulating
+// too many entries; unlike MaildirDataStore, none of this is meant to be
+// read by another MTA, so the layout is free to be whatever is most
+// convenient here.
+type FileDataStore struct {
+	fs   fsys
+	path string
+}
+
+// NewFileDataStore creates a FileDataStore rooted at path, backed by the
+// real filesystem.
+func NewFileDataStore(path string) DataStore {
+	return NewFileDataStoreFS(osFS{}, path)
+}
+
+// NewFileDataStoreFS creates a FileDataStore rooted at path, backed by
+// fs. This lets tests and benchmarks run against an in-memory filesystem
+// instead of real disk I/O, the same as NewMaildirDataStoreFS.
+func NewFileDataStoreFS(fs fsys, path string) DataStore {
+	ds := &FileDataStore{fs: fs, path: path}
+	if err := fs.MkdirAll(ds.mailPath(), 0770); err != nil {
+		log.Printf("smtpd: creating %v: %v", ds.mailPath(), err)
+	}
+	return ds
+}
+
+func (ds *FileDataStore) mailPath() string {
+	return filepath.Join(ds.path, "mail")
+}
+
+// AllMailboxes implements DataStore by walking the three levels of the
+// hashed directory layout looking for leaf directories that carry an
+// index.gob; fsys has no Walk, so this is done by hand one ReadDir at a
+// time.
+func (ds *FileDataStore) AllMailboxes() ([]Mailbox, error) {
+	level1, err := ds.fs.ReadDir(ds.mailPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("smtpd: reading %v: %v", ds.mailPath(), err)
+	}
+
+	var mailboxes []Mailbox
+	for _, e1 := range level1 {
+		if !e1.IsDir() {
+			continue
+		}
+		dir1 := filepath.Join(ds.mailPath(), e1.Name())
+		level2, err := ds.fs.ReadDir(dir1)
+		if err != nil {
+			return nil, fmt.Errorf("smtpd: reading %v: %v", dir1, err)
+		}
+		for _, e2 := range level2 {
+			if !e2.IsDir() {
+				continue
+			}
+			dir2 := filepath.Join(dir1, e2.Name())
+			level3, err := ds.fs.ReadDir(dir2)
+			if err != nil {
+				return nil, fmt.Errorf("smtpd: reading %v: %v", dir2, err)
+			}
+			for _, e3 := range level3 {
+				if !e3.IsDir() {
+					continue
+				}
+				mbPath := filepath.Join(dir2, e3.Name())
+				idx, err := ds.readIndex(mbPath)
+				if err != nil {
+					return nil, err
+				}
+				if idx.Name == "" {
+					// A hash directory with no index.gob isn't a mailbox
+					// (or has had its last message deleted but the empty
+					// parent dirs weren't cleaned up); skip it.
+					continue
+				}
+				mailboxes = append(mailboxes, &FileMailbox{store: ds, name: idx.Name, path: mbPath})
+			}
+		}
+	}
+	return mailboxes, nil
+}
+
+// AllQueues returns a FileMailbox for every mailbox that has ever had a
+// message Poll'd from it, found by walking ds.path's "queue" directory
+// rather than the "mail" hashed layout AllMailboxes walks: a mailbox
+// whose last message is in-flight has nothing left under "mail" for
+// AllMailboxes to find (FileMessage.Delete removes it once empty), but
+// its queueDir persists independently. Used by Reaper so an idle
+// mailbox's expired leases still get reclaimed.
+func (ds *FileDataStore) AllQueues() ([]*FileMailbox, error) {
+	queueRoot := filepath.Join(ds.path, "queue")
+	hashes, err := ds.fs.ReadDir(queueRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("smtpd: reading %v: %v", queueRoot, err)
+	}
+
+	var mailboxes []*FileMailbox
+	for _, h := range hashes {
+		if !h.IsDir() {
+			continue
+		}
+		hash := h.Name()
+		namePath := filepath.Join(queueRoot, hash, "name")
+		name, err := fsReadFile(ds.fs, namePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("smtpd: reading %v: %v", namePath, err)
+		}
+		path := filepath.Join(ds.mailPath(), hash[:3], hash[:6], hash)
+		mailboxes = append(mailboxes, &FileMailbox{store: ds, name: string(name), path: path})
+	}
+	return mailboxes, nil
+}
+
+// MailboxFor implements DataStore. It never touches disk: the mailbox's
+// directory and index are created lazily on first delivery, so looking up
+// a mailbox that has never received mail is cheap and side-effect free.
+func (ds *FileDataStore) MailboxFor(name string) (Mailbox, error) {
+	name = strings.ToLower(name)
+	h := sha1.Sum([]byte(name))
+	hash := hex.EncodeToString(h[:])
+	path := filepath.Join(ds.mailPath(), hash[:3], hash[:6], hash)
+	return &FileMailbox{store: ds, name: name, path: path}, nil
+}
+
+// fileIndexEntry records one message's id and delivery date within a
+// mailbox's index.gob, in delivery order.
+type fileIndexEntry struct {
+	ID   string
+	Date time.Time
+}
+
+// fileIndex is the gob-encoded contents of a mailbox's index.gob: the
+// mailbox's own name (the hashed directory name doesn't reveal it) plus
+// its messages in delivery order.
+type fileIndex struct {
+	Name    string
+	Entries []fileIndexEntry
+}
+
+func (ds *FileDataStore) indexPath(mbPath string) string {
+	return filepath.Join(mbPath, "index.gob")
+}
+
+// readIndex returns an empty, zero-value index (not an error) for a
+// mailbox that hasn't received its first message yet.
+func (ds *FileDataStore) readIndex(mbPath string) (fileIndex, error) {
+	f, err := ds.fs.Open(ds.indexPath(mbPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fileIndex{}, nil
+		}
+		return fileIndex{}, fmt.Errorf("smtpd: reading %v: %v", mbPath, err)
+	}
+	defer f.Close()
+	var idx fileIndex
+	if err := gob.NewDecoder(f).Decode(&idx); err != nil {
+		return fileIndex{}, fmt.Errorf("smtpd: decoding %v: %v", mbPath, err)
+	}
+	return idx, nil
+}
+
+func (ds *FileDataStore) writeIndex(mbPath string, idx fileIndex) error {
+	if err := ds.fs.MkdirAll(mbPath, 0770); err != nil {
+		return fmt.Errorf("smtpd: creating %v: %v", mbPath, err)
+	}
+	f, err := ds.fs.Create(ds.indexPath(mbPath))
+	if err != nil {
+		return fmt.Errorf("smtpd: writing %v: %v", mbPath, err)
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(idx)
+}
+
+// FileMailbox is the FileDataStore-backed implementation of Mailbox.
+type FileMailbox struct {
+	store *FileDataStore
+	name  string
+	path  string
+}
+
+// GetMessages implements Mailbox, returning messages in delivery order as
+// recorded by index.gob.
+func (mb *FileMailbox) GetMessages() ([]Message, error) {
+	idx, err := mb.store.readIndex(mb.path)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, len(idx.Entries))
+	for i, e := range idx.Entries {
+		msgs[i] = &FileMessage{mailbox: mb, Fid: e.ID, Fdate: e.Date}
+	}
+	return msgs, nil
+}
+
+// GetMessage implements Mailbox.
+func (mb *FileMailbox) GetMessage(id string) (Message, error) {
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.ID() == id {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("smtpd: no message %q in mailbox %q", id, mb.name)
+}
+
+// Purge implements Mailbox, removing every message.
+func (mb *FileMailbox) Purge() error {
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if err := m.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendIndex records id/date at the position in the mailbox's index.gob
+// matching date, keeping GetMessages' Date order intact, creating the
+// mailbox's directory on first delivery. A normal delivery's date is
+// always the newest so far, so this behaves as a plain append; it's
+// returnInflight's redelivery of a Nack'd or reclaimed message, which
+// must land back at its original Fdate rather than at the tail, that
+// needs the insert.
+func (mb *FileMailbox) appendIndex(id string, date time.Time) error {
+	idx, err := mb.store.readIndex(mb.path)
+	if err != nil {
+		return err
+	}
+	idx.Name = mb.name
+	i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].Date.After(date) })
+	idx.Entries = append(idx.Entries, fileIndexEntry{})
+	copy(idx.Entries[i+1:], idx.Entries[i:])
+	idx.Entries[i] = fileIndexEntry{ID: id, Date: date}
+	return mb.store.writeIndex(mb.path, idx)
+}
+
+// isIndexed reports whether id is currently present in the mailbox's
+// index.gob.
+func (mb *FileMailbox) isIndexed(id string) (bool, error) {
+	idx, err := mb.store.readIndex(mb.path)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range idx.Entries {
+		if e.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeIndex drops id from the mailbox's index.gob. Once the last entry
+// is gone, the whole mailbox directory is removed along with it, per
+// FileDataStore's original cleanup behavior.
+func (mb *FileMailbox) removeIndex(id string) error {
+	idx, err := mb.store.readIndex(mb.path)
+	if err != nil {
+		return err
+	}
+	var remaining []fileIndexEntry
+	for _, e := range idx.Entries {
+		if e.ID != id {
+			remaining = append(remaining, e)
+		}
+	}
+	if len(remaining) == 0 {
+		return mb.store.fs.RemoveAll(mb.path)
+	}
+	idx.Entries = remaining
+	return mb.store.writeIndex(mb.path, idx)
+}
+
+// fileIDSeq disambiguates ids generated within the same nanosecond.
+var fileIDSeq uint64
+
+// generateId builds an id for a message delivered at date: a zero-padded
+// nanosecond timestamp (so ids also sort correctly as strings) followed
+// by a process-wide sequence counter, the same disambiguation approach
+// newMaildirUniqueName uses for Maildir's unique names.
+func generateId(date time.Time) string {
+	seq := atomic.AddUint64(&fileIDSeq, 1)
+	return fmt.Sprintf("%020d.%016x", date.UnixNano(), seq)
+}
+
+// FileMessage is the FileDataStore-backed implementation of Message.
+type FileMessage struct {
+	mailbox  *FileMailbox
+	writable bool
+	Fdate    time.Time
+	Fid      string
+
+	wf file // open only between Append and Close while writable
+}
+
+// ID implements Message.
+func (m *FileMessage) ID() string { return m.Fid }
+
+func (m *FileMessage) rawPath() string {
+	return filepath.Join(m.mailbox.path, m.Fid+".raw")
+}
+
+// Size implements Message.
+func (m *FileMessage) Size() int {
+	fi, err := m.mailbox.store.fs.Stat(m.rawPath())
+	if err != nil {
+		return 0
+	}
+	return int(fi.Size())
+}
+
+// Subject implements Message, parsing it from the message headers on
+// demand since the index only carries id and date.
+func (m *FileMessage) Subject() string {
+	f, err := m.mailbox.store.fs.Open(m.rawPath())
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(bufio.NewReader(f))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Subject")
+}
+
+// Delete implements Message.
+func (m *FileMessage) Delete() error {
+	if err := m.mailbox.store.fs.Remove(m.rawPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("smtpd: deleting %v: %v", m.rawPath(), err)
+	}
+	return m.mailbox.removeIndex(m.Fid)
+}
+
+// Append implements Message, writing directly to the message's final
+// "<id>.raw" path; FileDataStore assigns ids up front (see generateId),
+// so unlike Maildir there's no separate tmp staging file to rename.
+func (m *FileMessage) Append(data []byte) error {
+	if !m.writable {
+		return fmt.Errorf("smtpd: message %v is not open for writing", m.Fid)
+	}
+	if m.wf == nil {
+		if err := m.mailbox.store.fs.MkdirAll(m.mailbox.path, 0770); err != nil {
+			return fmt.Errorf("smtpd: creating %v: %v", m.mailbox.path, err)
+		}
+		f, err := m.mailbox.store.fs.Create(m.rawPath())
+		if err != nil {
+			return fmt.Errorf("smtpd: creating %v: %v", m.rawPath(), err)
+		}
+		m.wf = f
+	}
+	_, err := m.wf.Write(data)
+	return err
+}
+
+// Close implements Message: it syncs and closes the raw file, then
+// records the message in the mailbox's index.gob, making it visible to
+// GetMessages.
+func (m *FileMessage) Close() error {
+	if !m.writable {
+		return nil
+	}
+	if m.wf != nil {
+		if err := m.wf.Sync(); err != nil {
+			m.wf.Close()
+			return fmt.Errorf("smtpd: syncing %v: %v", m.Fid, err)
+		}
+		if err := m.wf.Close(); err != nil {
+			return fmt.Errorf("smtpd: closing %v: %v", m.Fid, err)
+		}
+		m.wf = nil
+	}
+	m.writable = false
+	return m.mailbox.appendIndex(m.Fid, m.Fdate)
+}
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/vangual/inbucket/pop3d"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -23,41 +24,41 @@ func TestFSDirStructure(t *testing.T) {
 	mbName := "james"
 
 	// Check filestore root exists
-	assert.True(t, isDir(root), "Expected %q to be a directory", root)
+	assert.True(t, isDir(ds.fs, root), "Expected %q to be a directory", root)
 
 	// Check mail dir exists
 	expect := filepath.Join(root, "mail")
-	assert.True(t, isDir(expect), "Expected %q to be a directory", expect)
+	assert.True(t, isDir(ds.fs, expect), "Expected %q to be a directory", expect)
 
 	// Check first hash section does not exist
 	expect = filepath.Join(root, "mail", "474")
-	assert.False(t, isDir(expect), "Expected %q to not exist", expect)
+	assert.False(t, isDir(ds.fs, expect), "Expected %q to not exist", expect)
 
 	// Deliver test message
 	id1, _ := deliverMessage(ds, mbName, "test", time.Now())
 
 	// Check path to message exists
-	assert.True(t, isDir(expect), "Expected %q to be a directory", expect)
+	assert.True(t, isDir(ds.fs, expect), "Expected %q to be a directory", expect)
 	expect = filepath.Join(expect, "474ba6")
-	assert.True(t, isDir(expect), "Expected %q to be a directory", expect)
+	assert.True(t, isDir(ds.fs, expect), "Expected %q to be a directory", expect)
 	expect = filepath.Join(expect, "474ba67bdb289c6263b36dfd8a7bed6c85b04943")
-	assert.True(t, isDir(expect), "Expected %q to be a directory", expect)
+	assert.True(t, isDir(ds.fs, expect), "Expected %q to be a directory", expect)
 
 	// Check files
 	mbPath := expect
 	expect = filepath.Join(mbPath, "index.gob")
-	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	assert.True(t, isFile(ds.fs, expect), "Expected %q to be a file", expect)
 	expect = filepath.Join(mbPath, id1+".raw")
-	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	assert.True(t, isFile(ds.fs, expect), "Expected %q to be a file", expect)
 
 	// Deliver second test message
 	id2, _ := deliverMessage(ds, mbName, "test 2", time.Now())
 
 	// Check files
 	expect = filepath.Join(mbPath, "index.gob")
-	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	assert.True(t, isFile(ds.fs, expect), "Expected %q to be a file", expect)
 	expect = filepath.Join(mbPath, id2+".raw")
-	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	assert.True(t, isFile(ds.fs, expect), "Expected %q to be a file", expect)
 
 	// Delete message
 	mb, err := ds.MailboxFor(mbName)
@@ -69,9 +70,9 @@ func TestFSDirStructure(t *testing.T) {
 
 	// Message should be removed
 	expect = filepath.Join(mbPath, id1+".raw")
-	assert.False(t, isPresent(expect), "Did not expect %q to exist", expect)
+	assert.False(t, isPresent(ds.fs, expect), "Did not expect %q to exist", expect)
 	expect = filepath.Join(mbPath, "index.gob")
-	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	assert.True(t, isFile(ds.fs, expect), "Expected %q to be a file", expect)
 
 	// Delete message
 	msg, err = mb.GetMessage(id2)
@@ -81,13 +82,13 @@ func TestFSDirStructure(t *testing.T) {
 
 	// Message should be removed
 	expect = filepath.Join(mbPath, id2+".raw")
-	assert.False(t, isPresent(expect), "Did not expect %q to exist", expect)
+	assert.False(t, isPresent(ds.fs, expect), "Did not expect %q to exist", expect)
 
 	// No messages, index & maildir should be removed
 	expect = filepath.Join(mbPath, "index.gob")
-	assert.False(t, isPresent(expect), "Did not expect %q to exist", expect)
+	assert.False(t, isPresent(ds.fs, expect), "Did not expect %q to exist", expect)
 	expect = mbPath
-	assert.False(t, isPresent(expect), "Did not expect %q to exist", expect)
+	assert.False(t, isPresent(ds.fs, expect), "Did not expect %q to exist", expect)
 
 	if t.Failed() {
 		// Wait for handler to finish logging
@@ -334,18 +335,14 @@ func TestFSSize(t *testing.T) {
 	}
 }
 
-// setupDataStore creates a new FileDataStore in a temporary directory
+// setupDataStore creates a new FileDataStore on an in-memory filesystem, so
+// these tests need neither ioutil.TempDir nor any real disk I/O.
 func setupDataStore() (*FileDataStore, *bytes.Buffer) {
-	path, err := ioutil.TempDir("", "inbucket")
-	if err != nil {
-		panic(err)
-	}
-
 	// Capture log output
 	buf := new(bytes.Buffer)
 	log.SetOutput(buf)
 
-	return NewFileDataStore(path).(*FileDataStore), buf
+	return NewFileDataStoreFS(newMemFS(), "/data").(*FileDataStore), buf
 }
 
 // deliverMessage creates and delivers a message to the specific mailbox, returning
@@ -379,27 +376,132 @@ func deliverMessage(ds *FileDataStore, mbName string, subject string, date time.
 	return id, len(testMsg)
 }
 
-func teardownDataStore(ds *FileDataStore) {
-	if err := os.RemoveAll(ds.path); err != nil {
-		panic(err)
-	}
-}
+// teardownDataStore is a no-op now that setupDataStore runs on memFS, kept
+// so callers can keep deferring it uniformly.
+func teardownDataStore(ds *FileDataStore) {}
 
-func isPresent(path string) bool {
-	_, err := os.Lstat(path)
+func isPresent(fs fsys, path string) bool {
+	_, err := fs.Lstat(path)
 	return err == nil
 }
 
-func isFile(path string) bool {
-	if fi, err := os.Lstat(path); err == nil {
+func isFile(fs fsys, path string) bool {
+	if fi, err := fs.Lstat(path); err == nil {
 		return !fi.IsDir()
 	}
 	return false
 }
 
-func isDir(path string) bool {
-	if fi, err := os.Lstat(path); err == nil {
+func isDir(fs fsys, path string) bool {
+	if fi, err := fs.Lstat(path); err == nil {
 		return fi.IsDir()
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// Test retrieving an SMTP-delivered message over POP3, end-to-end against a
+// pop3d.Session wired to this mailbox's FileDataStore.
+func TestFSPop3Retrieve(t *testing.T) {
+	ds, logbuf := setupDataStore()
+	defer teardownDataStore(ds)
+
+	mbName := "james"
+	id, size := deliverMessage(ds, mbName, "hello", time.Now())
+
+	auth := pop3d.StaticAuthenticator{mbName: "secret"}
+	store := NewPOP3DataStore(ds)
+	cfg := pop3d.Config{Domain: "test.inbucket"}
+
+	client, server := net.Pipe()
+	go pop3d.NewSession(server, cfg, store, auth).Serve()
+
+	r := newPop3Reader(client)
+	defer client.Close()
+
+	r.expect(t, "+OK")
+	r.send(t, "USER "+mbName)
+	r.expect(t, "+OK")
+	r.send(t, "PASS secret")
+	r.expect(t, "+OK")
+
+	r.send(t, "STAT")
+	line := r.expect(t, "+OK")
+	assert.Equal(t, fmt.Sprintf("+OK 1 %d", size), line)
+
+	r.send(t, "RETR 1")
+	r.expect(t, fmt.Sprintf("+OK %d octets", size))
+	body := r.readUntilDot(t)
+	assert.Contains(t, body, "Subject: hello")
+
+	r.send(t, "DELE 1")
+	r.expect(t, "+OK")
+	r.send(t, "QUIT")
+	r.expect(t, "+OK")
+
+	// Deletion only commits on clean QUIT.
+	mb, err := ds.MailboxFor(mbName)
+	assert.Nil(t, err)
+	msgs, err := mb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(msgs))
+	_ = id
+
+	if t.Failed() {
+		time.Sleep(2 * time.Second)
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// pop3Reader is a minimal line-oriented client used to drive a pop3d.Session
+// over a net.Pipe in tests.
+type pop3Reader struct {
+	conn net.Conn
+	buf  *bytes.Buffer
+}
+
+func newPop3Reader(conn net.Conn) *pop3Reader {
+	return &pop3Reader{conn: conn, buf: new(bytes.Buffer)}
+}
+
+func (r *pop3Reader) send(t *testing.T, line string) {
+	if _, err := r.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatalf("writing %q: %v", line, err)
+	}
+}
+
+func (r *pop3Reader) readLine(t *testing.T) string {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		if buf[0] == '\n' {
+			return string(bytes.TrimRight(line, "\r"))
+		}
+		line = append(line, buf[0])
+	}
+}
+
+func (r *pop3Reader) expect(t *testing.T, prefix string) string {
+	line := r.readLine(t)
+	assert.True(t, len(line) >= len(prefix) && line[:len(prefix)] == prefix,
+		"expected response starting with %q, got %q", prefix, line)
+	return line
+}
+
+func (r *pop3Reader) readUntilDot(t *testing.T) string {
+	var out bytes.Buffer
+	for {
+		line := r.readLine(t)
+		if line == "." {
+			return out.String()
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+}
@@ -0,0 +1,51 @@
+package smtpd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// fsys abstracts the filesystem calls a DataStore backend needs, modeled on
+// spf13/afero, so backends can be driven by an in-memory filesystem in
+// tests or, eventually, a remote object store in production. osFS is the
+// default, real-disk implementation; memFS is for tests and benchmarks.
+// Both MaildirDataStore and FileDataStore go through fsys: each has a
+// NewXDataStoreFS(fs, path) constructor that NewXDataStore delegates to
+// with osFS{}.
+type fsys interface {
+	Create(name string) (file, error)
+	Open(name string) (file, error)
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Rename(oldname, newname string) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// file abstracts the subset of *os.File that backends need.
+type file interface {
+	io.ReadWriteCloser
+	Sync() error
+}
+
+// osFS implements fsys against the real, local filesystem.
+type osFS struct{}
+
+func (osFS) Create(name string) (file, error) { return os.Create(name) }
+func (osFS) Open(name string) (file, error)   { return os.Open(name) }
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	return os.OpenFile(name, flag, perm)
+}
+func (osFS) Mkdir(name string, perm os.FileMode) error     { return os.Mkdir(name, perm) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error  { return os.MkdirAll(path, perm) }
+func (osFS) Remove(name string) error                      { return os.Remove(name) }
+func (osFS) RemoveAll(path string) error                   { return os.RemoveAll(path) }
+func (osFS) Stat(name string) (os.FileInfo, error)         { return os.Stat(name) }
+func (osFS) Lstat(name string) (os.FileInfo, error)        { return os.Lstat(name) }
+func (osFS) Rename(oldname, newname string) error          { return os.Rename(oldname, newname) }
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
@@ -0,0 +1,63 @@
+package smtpd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// BenchmarkFileDataStoreDeliverMany delivers 10,000 messages to one
+// mailbox on memFS, opening the mailbox once per benchmark iteration
+// rather than before every delivery as TestFSDeliverMany does, and
+// without TestFSDeliverMany's O(n^2)
+// GetMessages-and-assert-after-every-delivery pattern, so it isolates
+// FileDataStore's own per-delivery cost (rewriting the whole index.gob
+// each time) as the mailbox grows.
+func BenchmarkFileDataStoreDeliverMany(b *testing.B) {
+	const messages = 10000
+	for n := 0; n < b.N; n++ {
+		ds := NewFileDataStoreFS(newMemFS(), "/data").(*FileDataStore)
+		mb, err := ds.MailboxFor("fred")
+		if err != nil {
+			b.Fatalf("MailboxFor: %v", err)
+		}
+		fmb := mb.(*FileMailbox)
+		for i := 0; i < messages; i++ {
+			raw := []byte(fmt.Sprintf("Subject: message %d\r\n\r\nbody\r\n", i))
+			date := time.Now()
+			msg := &FileMessage{mailbox: fmb, writable: true, Fdate: date, Fid: generateId(date)}
+			if err := msg.Append(raw); err != nil {
+				b.Fatalf("Append: %v", err)
+			}
+			if err := msg.Close(); err != nil {
+				b.Fatalf("Close: %v", err)
+			}
+		}
+	}
+}
+
+// BenchmarkMaildirDeliverMany delivers many messages to one mailbox on
+// memFS, re-opening the mailbox each iteration the way TestFSDeliverMany
+// does against FileDataStore. It exists to gate future performance work on
+// the pluggable-filesystem path.
+func BenchmarkMaildirDeliverMany(b *testing.B) {
+	ds := NewMaildirDataStoreFS(newMemFS(), "/mail")
+
+	for i := 0; i < b.N; i++ {
+		mb, err := ds.MailboxFor("fred")
+		if err != nil {
+			b.Fatalf("MailboxFor: %v", err)
+		}
+		msg, err := mb.(*MaildirMailbox).NewMessage()
+		if err != nil {
+			b.Fatalf("NewMessage: %v", err)
+		}
+		raw := []byte(fmt.Sprintf("Subject: message %d\r\n\r\nbody\r\n", i))
+		if err := msg.Append(raw); err != nil {
+			b.Fatalf("Append: %v", err)
+		}
+		if err := msg.Close(); err != nil {
+			b.Fatalf("Close: %v", err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// mboxDateLayout is the timestamp format traditionally used in mbox "From "
+// envelope lines, e.g. "Mon Jan  2 15:04:05 2006".
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+
+// mboxFromLine matches a (possibly quoted) mbox envelope line.
+var mboxFromLine = regexp.MustCompile(`^>*From[ \t]`)
+
+// ExportMbox streams every message in the mailbox to w in traditional Unix
+// mbox format: each message is preceded by a "From " envelope line, and any
+// body line that would otherwise be mistaken for one is quoted with a
+// leading ">". mbox's envelope line can't represent a delivery timestamp
+// precisely, so the original is also carried in an added
+// X-Inbucket-Received header, letting ExportMbox -> ImportMbox round-trip
+// exactly. Messages are streamed one at a time; the mailbox is never
+// buffered in full.
+func (mb *FileMailbox) ExportMbox(w io.Writer) error {
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		return fmt.Errorf("smtpd: listing %v for export: %v", mb.name, err)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, msg := range msgs {
+		if err := writeMboxMessage(bw, msg.(*FileMessage)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeMboxMessage(bw *bufio.Writer, fm *FileMessage) error {
+	r, err := fm.ReadRaw()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err := fmt.Fprintf(bw, "From MAILER-DAEMON %s\r\n", fm.Fdate.UTC().Format(mboxDateLayout)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(bw, "X-Inbucket-Received: %s\r\n", fm.Fdate.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if mboxFromLine.MatchString(line) {
+			line = ">" + line
+		}
+		if _, err := bw.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("smtpd: reading %v for export: %v", fm.Fid, err)
+	}
+	_, err = bw.WriteString("\r\n")
+	return err
+}
+
+// ImportMbox parses r as a traditional Unix mbox stream and delivers each
+// message it contains to the mailbox, returning how many were imported.
+// Messages carrying an X-Inbucket-Received header (as written by
+// ExportMbox) are delivered with that original timestamp rather than the
+// import time, so an Export -> Import round trip preserves ordering.
+// Messages are parsed and delivered one at a time; the stream is never
+// buffered in full.
+func (mb *FileMailbox) ImportMbox(r io.Reader) (count int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	var cur *bytes.Buffer
+	var date time.Time
+	pendingBlankLines := 0
+
+	flush := func() error {
+		if cur == nil {
+			return nil
+		}
+		if _, err := mb.deliverRaw(cur.Bytes(), date); err != nil {
+			return err
+		}
+		count++
+		cur = nil
+		pendingBlankLines = 0
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if mboxFromLine.MatchString(line) && !strings.HasPrefix(line, ">") {
+			// The blank line preceding this envelope is the separator
+			// between messages, not part of the previous message's body.
+			if err := flush(); err != nil {
+				return count, err
+			}
+			cur = new(bytes.Buffer)
+			date = time.Now()
+			continue
+		}
+		if cur == nil {
+			// Garbage before the first envelope line; ignore per mbox
+			// convention.
+			continue
+		}
+		if strings.HasPrefix(line, ">") && mboxFromLine.MatchString(line) {
+			line = line[1:]
+		}
+		if strings.HasPrefix(line, "X-Inbucket-Received:") {
+			value := strings.TrimSpace(strings.TrimPrefix(line, "X-Inbucket-Received:"))
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				date = t
+			}
+			continue
+		}
+		if line == "" {
+			// Hold blank lines back: if a "From " envelope or EOF follows,
+			// this is the inter-message separator rather than body content.
+			pendingBlankLines++
+			continue
+		}
+		for ; pendingBlankLines > 0; pendingBlankLines-- {
+			cur.WriteString("\r\n")
+		}
+		cur.WriteString(line)
+		cur.WriteString("\r\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("smtpd: reading mbox stream: %v", err)
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// deliverRaw persists a new message with the given raw RFC822 content and
+// delivery date as a writable FileMessage with a fresh generateId id, and
+// returns that id.
+func (mb *FileMailbox) deliverRaw(raw []byte, date time.Time) (string, error) {
+	msg := &FileMessage{
+		mailbox:  mb,
+		writable: true,
+		Fdate:    date,
+		Fid:      generateId(date),
+	}
+	if err := msg.Append(raw); err != nil {
+		return "", fmt.Errorf("smtpd: importing message: %v", err)
+	}
+	if err := msg.Close(); err != nil {
+		return "", err
+	}
+	return msg.Fid, nil
+}
@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMboxRoundTrip verifies that messages delivered via deliverMessage
+// survive an ExportMbox -> ImportMbox round trip with identical
+// Subject/Size/ordering.
+func TestMboxRoundTrip(t *testing.T) {
+	ds, logbuf := setupDataStore()
+	defer teardownDataStore(ds)
+
+	subjects := []string{"alpha", "bravo", "charlie"}
+	base := time.Now().Add(-time.Hour)
+	for i, subj := range subjects {
+		deliverMessage(ds, "fred", subj, base.Add(time.Duration(i)*time.Minute))
+	}
+
+	srcMb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, srcMb.(*FileMailbox).ExportMbox(&buf))
+
+	dstMb, err := ds.MailboxFor("imported")
+	assert.Nil(t, err)
+	count, err := dstMb.(*FileMailbox).ImportMbox(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, len(subjects), count)
+
+	srcMsgs, err := srcMb.GetMessages()
+	assert.Nil(t, err)
+	dstMsgs, err := dstMb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, len(srcMsgs), len(dstMsgs))
+
+	for i := range srcMsgs {
+		assert.Equal(t, srcMsgs[i].Subject(), dstMsgs[i].Subject())
+		assert.Equal(t, srcMsgs[i].Size(), dstMsgs[i].Size())
+		assert.True(t, srcMsgs[i].(*FileMessage).Fdate.Equal(dstMsgs[i].(*FileMessage).Fdate),
+			"expected delivery date to round-trip for message %d", i)
+	}
+
+	if t.Failed() {
+		time.Sleep(2 * time.Second)
+		buf2 := logbuf.String()
+		_ = buf2
+	}
+}
+
+// TestMboxFromQuoting verifies that a body line beginning with "From " is
+// quoted on export and restored verbatim on import.
+func TestMboxFromQuoting(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	fm := mb.(*FileMailbox)
+
+	raw := []byte("To: somebody@host\r\n" +
+		"From: somebodyelse@host\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"From the start of a line\r\n" +
+		"Regular line\r\n")
+	_, err = fm.deliverRaw(raw, time.Now())
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, fm.ExportMbox(&buf))
+	assert.Contains(t, buf.String(), ">From the start of a line")
+
+	dst, err := ds.MailboxFor("quoted")
+	assert.Nil(t, err)
+	count, err := dst.(*FileMailbox).ImportMbox(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	msgs, err := dst.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	r, err := msgs[0].(*FileMessage).ReadRaw()
+	assert.Nil(t, err)
+	defer r.Close()
+	body := new(bytes.Buffer)
+	body.ReadFrom(r)
+	assert.Contains(t, body.String(), "From the start of a line")
+	assert.NotContains(t, body.String(), ">From the start of a line")
+}
@@ -0,0 +1,246 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is an in-memory fsys, for fast unit tests and benchmarks that would
+// otherwise need ioutil.TempDir and real disk I/O.
+type memFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // keyed by filepath.Clean path
+}
+
+type memNode struct {
+	name    string
+	isDir   bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+// newMemFS returns an empty in-memory filesystem rooted at "/".
+func newMemFS() *memFS {
+	fs := &memFS{nodes: make(map[string]*memNode)}
+	fs.nodes["/"] = &memNode{name: "/", isDir: true, mode: os.ModeDir | 0770, modTime: time.Now()}
+	return fs
+}
+
+func memClean(name string) string {
+	name = filepath.ToSlash(filepath.Clean("/" + name))
+	return name
+}
+
+func (fs *memFS) parent(name string) string {
+	dir := filepath.ToSlash(filepath.Dir(name))
+	if dir == "." {
+		dir = "/"
+	}
+	return dir
+}
+
+func (fs *memFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = memClean(name)
+	if _, ok := fs.nodes[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	parent := fs.parent(name)
+	if n, ok := fs.nodes[parent]; !ok || !n.isDir {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	fs.nodes[name] = &memNode{name: filepath.Base(name), isDir: true, mode: os.ModeDir | perm, modTime: time.Now()}
+	return nil
+}
+
+func (fs *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = memClean(path)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	cur := ""
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		cur += "/" + p
+		if err := fs.Mkdir(cur, perm); err != nil {
+			fs.mu.Lock()
+			_, exists := fs.nodes[memClean(cur)]
+			fs.mu.Unlock()
+			if !exists {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Create(name string) (file, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+}
+
+func (fs *memFS) Open(name string) (file, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clean := memClean(name)
+	n, ok := fs.nodes[clean]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if flag&os.O_EXCL != 0 {
+			// fall through to creation below
+		}
+		parent := fs.parent(clean)
+		if pn, ok := fs.nodes[parent]; !ok || !pn.isDir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		n = &memNode{name: filepath.Base(clean), mode: perm, modTime: time.Now()}
+		fs.nodes[clean] = n
+	} else if flag&os.O_EXCL != 0 && flag&os.O_CREATE != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	} else if flag&os.O_TRUNC != 0 {
+		n.data = nil
+	}
+	if n.isDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+
+	mf := &memFile{fs: fs, node: n}
+	if flag&os.O_APPEND != 0 {
+		mf.pos = len(n.data)
+	}
+	return mf, nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clean := memClean(name)
+	if _, ok := fs.nodes[clean]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.nodes, clean)
+	return nil
+}
+
+func (fs *memFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clean := memClean(path)
+	prefix := clean + "/"
+	for p := range fs.nodes {
+		if p == clean || strings.HasPrefix(p, prefix) {
+			delete(fs.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error)  { return fs.stat(name) }
+func (fs *memFS) Lstat(name string) (os.FileInfo, error) { return fs.stat(name) }
+
+func (fs *memFS) stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[memClean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{n}, nil
+}
+
+func (fs *memFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldClean, newClean := memClean(oldname), memClean(newname)
+	n, ok := fs.nodes[oldClean]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	delete(fs.nodes, oldClean)
+	n.name = filepath.Base(newClean)
+	fs.nodes[newClean] = n
+	return nil
+}
+
+func (fs *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clean := memClean(dirname)
+	if n, ok := fs.nodes[clean]; !ok || !n.isDir {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	prefix := clean
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var out []os.FileInfo
+	for p, n := range fs.nodes {
+		if p == clean || !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if strings.Contains(strings.TrimPrefix(p, prefix), "/") {
+			continue // not a direct child
+		}
+		out = append(out, memFileInfo{n})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// memFile is an open handle onto a memNode's byte buffer.
+type memFile struct {
+	fs   *memFS
+	node *memNode
+	pos  int
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.pos >= len(f.node.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.pos+len(p) > len(f.node.data) {
+		grown := make([]byte, f.pos+len(p))
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	n := copy(f.node.data[f.pos:], p)
+	f.pos += n
+	f.node.modTime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) Close() error { return nil }
+func (f *memFile) Sync() error  { return nil }
+
+// memFileInfo adapts memNode to os.FileInfo.
+type memFileInfo struct{ n *memNode }
+
+func (i memFileInfo) Name() string       { return i.n.name }
+func (i memFileInfo) Size() int64        { return int64(len(i.n.data)) }
+func (i memFileInfo) Mode() os.FileMode  { return i.n.mode }
+func (i memFileInfo) ModTime() time.Time { return i.n.modTime }
+func (i memFileInfo) IsDir() bool        { return i.n.isDir }
+func (i memFileInfo) Sys() interface{}   { return nil }
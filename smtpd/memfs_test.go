@@ -0,0 +1,105 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemFSBasics exercises memFS directly: the MaildirDataStore tests
+// below already cover it indirectly, but this pins down the primitives.
+func TestMemFSBasics(t *testing.T) {
+	fs := newMemFS()
+
+	assert.Nil(t, fs.MkdirAll("/mail/fred/cur", 0770))
+
+	f, err := fs.Create("/mail/fred/cur/1")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	fi, err := fs.Stat("/mail/fred/cur/1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+
+	rf, err := fs.Open("/mail/fred/cur/1")
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(rf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	rf.Close()
+
+	entries, err := fs.ReadDir("/mail/fred/cur")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "1", entries[0].Name())
+
+	assert.Nil(t, fs.Rename("/mail/fred/cur/1", "/mail/fred/cur/2"))
+	_, err = fs.Stat("/mail/fred/cur/1")
+	assert.NotNil(t, err)
+	_, err = fs.Stat("/mail/fred/cur/2")
+	assert.Nil(t, err)
+
+	assert.Nil(t, fs.Remove("/mail/fred/cur/2"))
+	_, err = fs.Stat("/mail/fred/cur/2")
+	assert.NotNil(t, err)
+}
+
+// TestMaildirOnMemFS runs the MaildirDataStore delivery path entirely
+// in-memory, with no ioutil.TempDir.
+func TestMaildirOnMemFS(t *testing.T) {
+	ds := NewMaildirDataStoreFS(newMemFS(), "/mail")
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	msg, err := mb.(*MaildirMailbox).NewMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Append([]byte("Subject: hi\r\n\r\nbody\r\n")))
+	assert.Nil(t, msg.Close())
+
+	mb, err = ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	msgs, err := mb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, "hi", msgs[0].Subject())
+}
+
+// TestMaildirOrderBySequenceOnTimestampTie confirms GetMessages breaks a
+// tie between messages sharing a nanosecond timestamp (a fast delivery
+// loop, or a coarse system clock) using the "_seq" disambiguator in their
+// unique names, rather than falling back to directory-read order.
+func TestMaildirOrderBySequenceOnTimestampTie(t *testing.T) {
+	ds := NewMaildirDataStoreFS(newMemFS(), "/mail")
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	fmb := mb.(*MaildirMailbox)
+
+	// Deliver directly under hand-crafted names sharing one timestamp, in
+	// reverse sequence order. ReadDir returns them sorted by name
+	// (P1_10, P1_11, P1_9), so a ReadDir-order fallback would fail.
+	names := []string{
+		"1000.P1_11.localhost",
+		"1000.P1_10.localhost",
+		"1000.P1_9.localhost",
+	}
+	for _, name := range names {
+		msg := &MaildirMessage{mailbox: fmb, dir: "tmp", filename: name}
+		f, err := fmb.store.fs.Create(filepath.Join(fmb.path, "tmp", name))
+		assert.Nil(t, err)
+		msg.tmpFile = f
+		assert.Nil(t, msg.Append([]byte("Subject: "+name+"\r\n\r\nbody\r\n")))
+		assert.Nil(t, msg.Close())
+	}
+
+	msgs, err := fmb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, "1000.P1_9.localhost", msgs[0].(*MaildirMessage).ID())
+	assert.Equal(t, "1000.P1_10.localhost", msgs[1].(*MaildirMessage).ID())
+	assert.Equal(t, "1000.P1_11.localhost", msgs[2].(*MaildirMessage).ID())
+}
@@ -0,0 +1,47 @@
+package smtpd
+
+import "github.com/vangual/inbucket/pop3d"
+
+// pop3DataStore adapts a *FileDataStore to pop3d.DataStore, translating
+// between this package's exported Mailbox interface and pop3d's narrower
+// one.
+type pop3DataStore struct {
+	ds *FileDataStore
+}
+
+// NewPOP3DataStore exposes ds to a pop3d.Server, so operators can enable
+// POP3 retrieval alongside SMTP delivery against the same mail store.
+func NewPOP3DataStore(ds *FileDataStore) pop3d.DataStore {
+	return pop3DataStore{ds: ds}
+}
+
+// MailboxFor implements pop3d.DataStore.
+func (d pop3DataStore) MailboxFor(name string) (pop3d.Mailbox, error) {
+	mb, err := d.ds.MailboxFor(name)
+	if err != nil {
+		return nil, err
+	}
+	return pop3Mailbox{mb: mb.(*FileMailbox)}, nil
+}
+
+// pop3Mailbox adapts a *FileMailbox to pop3d.Mailbox.
+type pop3Mailbox struct {
+	mb *FileMailbox
+}
+
+func (m pop3Mailbox) Lock() error { return m.mb.Lock() }
+func (m pop3Mailbox) Unlock()     { m.mb.Unlock() }
+
+// GetMessages implements pop3d.Mailbox. *FileMessage already satisfies
+// pop3d.Message, so each element is converted with a plain type assertion.
+func (m pop3Mailbox) GetMessages() ([]pop3d.Message, error) {
+	msgs, err := m.mb.GetMessages()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]pop3d.Message, len(msgs))
+	for i, msg := range msgs {
+		out[i] = msg.(*FileMessage)
+	}
+	return out, nil
+}
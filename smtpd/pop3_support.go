@@ -0,0 +1,51 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// mailboxLocks tracks which mailboxes currently have an exclusive holder,
+// keyed by mailbox path. Exclusive access is process-local: it exists so a
+// retrieval protocol (e.g. pop3d) can take a message snapshot and later
+// commit deletions against it without racing a concurrent session for the
+// same mailbox.
+var (
+	mailboxLocksMu sync.Mutex
+	mailboxLocks   = make(map[string]bool)
+)
+
+// Lock grants the caller exclusive access to this mailbox. It returns an
+// error if another caller already holds the lock; callers must release it
+// with Unlock when finished.
+func (mb *FileMailbox) Lock() error {
+	mailboxLocksMu.Lock()
+	defer mailboxLocksMu.Unlock()
+	if mailboxLocks[mb.path] {
+		return fmt.Errorf("smtpd: mailbox %q is locked by another session", mb.name)
+	}
+	mailboxLocks[mb.path] = true
+	return nil
+}
+
+// Unlock releases a lock previously acquired with Lock. Unlocking a mailbox
+// that isn't locked is a no-op.
+func (mb *FileMailbox) Unlock() {
+	mailboxLocksMu.Lock()
+	defer mailboxLocksMu.Unlock()
+	delete(mailboxLocks, mb.path)
+}
+
+// ReadRaw opens the on-disk representation of the message and returns it as
+// a streaming reader of its complete RFC 822 form (headers and body), for
+// use by retrieval protocols such as POP3's RETR and TOP commands. The
+// caller must Close the returned reader.
+func (m *FileMessage) ReadRaw() (io.ReadCloser, error) {
+	path := m.rawPath()
+	f, err := m.mailbox.store.fs.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: opening %v: %v", path, err)
+	}
+	return f, nil
+}
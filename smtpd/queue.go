@@ -0,0 +1,445 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsReadFile and fsWriteFile are ioutil.ReadFile/WriteFile's fsys
+// equivalents, so the inflight/lease/queue files below go through the
+// same pluggable filesystem as the rest of FileDataStore instead of
+// talking to the OS directly.
+func fsReadFile(fs fsys, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func fsWriteFile(fs fsys, path string, data []byte) error {
+	f, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// pollLeaseDuration is how long a message polled off a mailbox's queue may
+// stay in-flight before reclaimExpired treats its lease as abandoned and
+// returns it to the mailbox. It's a var rather than a const so tests can
+// shorten it instead of sleeping for real.
+var pollLeaseDuration = 30 * time.Second
+
+// ErrQueueEmpty is returned by Poll when the mailbox currently has no
+// message available (everything already in-flight, or simply empty).
+var ErrQueueEmpty = errors.New("smtpd: mailbox queue is empty")
+
+// queueMu serializes Poll/Ack/Nack and the Reaper across all mailboxes in
+// this process, protecting the inflight directory, lease file and queue
+// file this feature owns. Poll (via Message.Delete) and returnInflight
+// (via isIndexed/appendIndex) also read and rewrite index.gob; ordinary
+// deliveries do not take queueMu, so those index.gob updates are not
+// serialized against them.
+var queueMu sync.Mutex
+
+// Poll marks the oldest message not already in-flight as claimed by a
+// consumer and returns it, moving its content into an inflight directory
+// under queueDir (rooted at the store's "queue" directory, not under the
+// mailbox's own hashed directory), with a lease recorded alongside it. A
+// Nack'd or reclaimed message is given priority over the mailbox's
+// natural delivery order, so it comes back out first. Returns
+// ErrQueueEmpty if nothing is available.
+//
+// Because index.gob's on-disk layout belongs to FileDataStore's own
+// implementation, Poll never edits it directly: it reads the candidate
+// message with the regular Mailbox/Message API and removes it with
+// Message.Delete, the same as any other consumer would. A Nack'd or
+// reclaimed message keeps its original id across the round trip (see
+// returnInflight), so callers may rely on ID() staying stable.
+func (mb *FileMailbox) Poll() (*FileMessage, error) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if err := mb.reclaimExpired(time.Now()); err != nil {
+		return nil, err
+	}
+
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: polling %v: %v", mb.name, err)
+	}
+
+	leases, err := mb.readLeases()
+	if err != nil {
+		return nil, err
+	}
+	inflight := make(map[string]bool, len(leases))
+	for _, l := range leases {
+		inflight[l.id] = true
+	}
+
+	queued, err := mb.readQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	var chosen *FileMessage
+	for _, id := range queued {
+		if inflight[id] {
+			continue
+		}
+		for _, m := range msgs {
+			if fm := m.(*FileMessage); fm.Fid == id {
+				chosen = fm
+				break
+			}
+		}
+		if chosen != nil {
+			break
+		}
+	}
+	if chosen == nil {
+		for _, m := range msgs {
+			if fm := m.(*FileMessage); !inflight[fm.Fid] {
+				chosen = fm
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		return nil, ErrQueueEmpty
+	}
+
+	if err := mb.writeQueue(removeID(queued, chosen.Fid)); err != nil {
+		return nil, err
+	}
+
+	r, err := chosen.ReadRaw()
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: reading %v to poll: %v", chosen.Fid, err)
+	}
+	raw, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: reading %v to poll: %v", chosen.Fid, err)
+	}
+
+	deadline := time.Now().Add(pollLeaseDuration)
+	if err := mb.writeInflight(chosen.Fid, chosen.Fdate, deadline, raw, leases); err != nil {
+		return nil, err
+	}
+	if err := chosen.Delete(); err != nil {
+		return nil, fmt.Errorf("smtpd: removing polled message %v from mailbox: %v", chosen.Fid, err)
+	}
+
+	// Point the returned message at its inflight copy so Subject/Size/
+	// ReadRaw keep working even though it's gone from the mailbox proper.
+	chosen.mailbox = &FileMailbox{store: mb.store, name: mb.name, path: mb.inflightDir()}
+	return chosen, nil
+}
+
+// Ack permanently removes a message previously returned by Poll,
+// acknowledging that its consumer is done with it.
+func (mb *FileMailbox) Ack(id string) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	leases, err := mb.readLeases()
+	if err != nil {
+		return err
+	}
+	remaining, found := removeLease(leases, id)
+	if !found {
+		return fmt.Errorf("smtpd: no in-flight message %q", id)
+	}
+	if err := mb.store.fs.Remove(filepath.Join(mb.inflightDir(), id+".raw")); err != nil {
+		return fmt.Errorf("smtpd: acking %v: %v", id, err)
+	}
+	return mb.writeLeases(remaining)
+}
+
+// Nack returns a message previously returned by Poll to the mailbox,
+// preserving its original id and Fdate, and puts it at the head of the
+// queue so it's the next Poll result even if other messages have since
+// arrived.
+func (mb *FileMailbox) Nack(id string) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	return mb.returnInflight(id)
+}
+
+// reclaimExpired redelivers every inflight message whose lease has
+// passed, at the head of the queue, exactly as Nack does. Called at the
+// top of every Poll so a consumer that crashed without Ack/Nack-ing
+// eventually loses its claim, including across a process restart since
+// the lease deadline is read back from disk, not kept in memory.
+func (mb *FileMailbox) reclaimExpired(now time.Time) error {
+	leases, err := mb.readLeases()
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		if now.Before(l.deadline) {
+			continue
+		}
+		if err := mb.returnInflight(l.id); err != nil {
+			return fmt.Errorf("smtpd: reclaiming lease for %v: %v", l.id, err)
+		}
+	}
+	return nil
+}
+
+// returnInflight redelivers the inflight message id back into the mailbox
+// by renaming its raw content back into place, so unlike deliverRaw it
+// preserves the message's original id rather than minting a new one, puts
+// that id at the head of the queue, and removes the lease. Shared by Nack
+// and reclaimExpired.
+//
+// Poll writes the inflight copy and lease before it calls Delete to
+// remove the message from the mailbox proper, so a crash (or any other
+// failure) landing between those two steps leaves id both inflight and
+// still indexed. returnInflight tolerates that: it checks isIndexed
+// first and skips the rename/appendIndex step when the message is
+// already there, so a retry (e.g. from the reaper) can't duplicate it in
+// GetMessages.
+func (mb *FileMailbox) returnInflight(id string) error {
+	leases, err := mb.readLeases()
+	if err != nil {
+		return err
+	}
+	lease, ok := findLease(leases, id)
+	if !ok {
+		return fmt.Errorf("smtpd: no in-flight message %q", id)
+	}
+
+	indexed, err := mb.isIndexed(id)
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(mb.inflightDir(), id+".raw")
+	if !indexed {
+		dst := filepath.Join(mb.path, id+".raw")
+		if err := mb.store.fs.MkdirAll(mb.path, 0770); err != nil {
+			return fmt.Errorf("smtpd: redelivering %v: %v", id, err)
+		}
+		if err := mb.store.fs.Rename(src, dst); err != nil {
+			return fmt.Errorf("smtpd: redelivering %v: %v", id, err)
+		}
+		if err := mb.appendIndex(id, lease.date); err != nil {
+			return err
+		}
+	} else if err := mb.store.fs.Remove(src); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("smtpd: cleaning up in-flight copy of %v: %v", id, err)
+	}
+
+	remaining, _ := removeLease(leases, id)
+	if err := mb.writeLeases(remaining); err != nil {
+		return err
+	}
+	queued, err := mb.readQueue()
+	if err != nil {
+		return err
+	}
+	for _, q := range queued {
+		if q == id {
+			return nil
+		}
+	}
+	return mb.writeQueue(append([]string{id}, queued...))
+}
+
+// queueDir holds this mailbox's inflight/lease/queue state, keyed by the
+// mailbox's hash directory name but rooted outside mb.path entirely: a
+// message's raw content briefly lives in both mb.path (until Poll removes
+// it) and under here, and FileMessage.Delete removes mb.path outright once
+// its last message is gone (see TestFSDirStructure), so queue state can't
+// live anywhere under mb.path without risking that cleanup taking it out
+// along with the mailbox.
+func (mb *FileMailbox) queueDir() string {
+	return filepath.Join(mb.store.path, "queue", filepath.Base(mb.path))
+}
+
+func (mb *FileMailbox) inflightDir() string {
+	return filepath.Join(mb.queueDir(), "inflight")
+}
+
+// lease records that id's content is sitting in inflightDir, along with
+// the original delivery date (needed to redeliver faithfully) and the
+// deadline by which a consumer must Ack or Nack it.
+type lease struct {
+	id       string
+	date     time.Time
+	deadline time.Time
+}
+
+func findLease(leases []lease, id string) (lease, bool) {
+	for _, l := range leases {
+		if l.id == id {
+			return l, true
+		}
+	}
+	return lease{}, false
+}
+
+func removeLease(leases []lease, id string) ([]lease, bool) {
+	out := make([]lease, 0, len(leases))
+	found := false
+	for _, l := range leases {
+		if l.id == id {
+			found = true
+			continue
+		}
+		out = append(out, l)
+	}
+	return out, found
+}
+
+// leasePath holds one line per inflight message: id, lease deadline and
+// original delivery date, all as Unix nanoseconds.
+func (mb *FileMailbox) leasePath() string {
+	return filepath.Join(mb.queueDir(), "leases")
+}
+
+func (mb *FileMailbox) readLeases() ([]lease, error) {
+	data, err := fsReadFile(mb.store.fs, mb.leasePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var leases []lease
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		deadlineNs, err1 := strconv.ParseInt(fields[1], 10, 64)
+		dateNs, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		leases = append(leases, lease{
+			id:       fields[0],
+			deadline: time.Unix(0, deadlineNs),
+			date:     time.Unix(0, dateNs),
+		})
+	}
+	return leases, nil
+}
+
+func (mb *FileMailbox) writeLeases(leases []lease) error {
+	if len(leases) == 0 {
+		err := mb.store.fs.Remove(mb.leasePath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var sb strings.Builder
+	for _, l := range leases {
+		fmt.Fprintf(&sb, "%s %d %d\n", l.id, l.deadline.UnixNano(), l.date.UnixNano())
+	}
+	if err := mb.store.fs.MkdirAll(mb.queueDir(), 0770); err != nil {
+		return err
+	}
+	return fsWriteFile(mb.store.fs, mb.leasePath(), []byte(sb.String()))
+}
+
+// writeInflight stashes a polled message's raw content under inflightDir
+// as "<id>.raw" (so the existing Fid-keyed accessors keep working against
+// it) and records its lease.
+func (mb *FileMailbox) writeInflight(id string, date, deadline time.Time, raw []byte, leases []lease) error {
+	if err := mb.store.fs.MkdirAll(mb.inflightDir(), 0770); err != nil {
+		return fmt.Errorf("smtpd: creating inflight dir for %v: %v", mb.name, err)
+	}
+	path := filepath.Join(mb.inflightDir(), id+".raw")
+	if err := fsWriteFile(mb.store.fs, path, raw); err != nil {
+		return fmt.Errorf("smtpd: writing inflight copy of %v: %v", id, err)
+	}
+	if err := mb.writeQueueName(); err != nil {
+		return err
+	}
+	leases = append(leases, lease{id: id, date: date, deadline: deadline})
+	return mb.writeLeases(leases)
+}
+
+// queueNamePath records the mailbox name queueDir belongs to. Poll's last
+// message may be removed out from under it (see queueDir), leaving
+// queueDir as the only trace of the mailbox on disk; this file is what
+// lets FileDataStore.AllQueues rediscover such a mailbox by name rather
+// than only by hash.
+func (mb *FileMailbox) queueNamePath() string {
+	return filepath.Join(mb.queueDir(), "name")
+}
+
+// writeQueueName records mb.name in queueNamePath, if it isn't already
+// there; called once queueDir is known to exist, from writeInflight.
+func (mb *FileMailbox) writeQueueName() error {
+	if _, err := mb.store.fs.Stat(mb.queueNamePath()); err == nil {
+		return nil
+	}
+	return fsWriteFile(mb.store.fs, mb.queueNamePath(), []byte(mb.name))
+}
+
+// queuePath holds ids of Nack'd or reclaimed messages that should be the
+// next Poll result, in priority order.
+func (mb *FileMailbox) queuePath() string {
+	return filepath.Join(mb.queueDir(), "queue")
+}
+
+func (mb *FileMailbox) readQueue() ([]string, error) {
+	data, err := fsReadFile(mb.store.fs, mb.queuePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			ids = append(ids, l)
+		}
+	}
+	return ids, nil
+}
+
+func (mb *FileMailbox) writeQueue(ids []string) error {
+	if len(ids) == 0 {
+		err := mb.store.fs.Remove(mb.queuePath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := mb.store.fs.MkdirAll(mb.queueDir(), 0770); err != nil {
+		return err
+	}
+	return fsWriteFile(mb.store.fs, mb.queuePath(), []byte(strings.Join(ids, "\n")+"\n"))
+}
+
+func removeID(ids []string, id string) []string {
+	out := make([]string, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			out = append(out, i)
+		}
+	}
+	return out
+}
@@ -0,0 +1,239 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Poll/Ack removes a message for good, same as Delete would.
+func TestFSQueuePollAck(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	deliverMessage(ds, "fred", "alpha", time.Now())
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msg, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", msg.Subject())
+
+	assert.Nil(t, fmb.Ack(msg.ID()))
+
+	msgs, err := fmb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	_, err = fmb.Poll()
+	assert.Equal(t, ErrQueueEmpty, err)
+}
+
+// A Nack'd message comes back out of Poll next, ahead of messages that
+// arrived in the meantime.
+func TestFSQueueNackTakesPriority(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	deliverMessage(ds, mbName, "alpha", time.Now())
+
+	mb, err := ds.MailboxFor(mbName)
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msg, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", msg.Subject())
+
+	// A newer message arrives while "alpha" is in flight.
+	deliverMessage(ds, mbName, "bravo", time.Now())
+
+	assert.Nil(t, fmb.Nack(msg.ID()))
+
+	next, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", next.Subject())
+
+	assert.Nil(t, fmb.Ack(next.ID()))
+
+	next, err = fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "bravo", next.Subject())
+}
+
+// An expired lease is reclaimed automatically on the next Poll, without
+// any explicit Ack/Nack from the stuck consumer.
+func TestFSQueueReclaimExpiredLease(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	old := pollLeaseDuration
+	pollLeaseDuration = 10 * time.Millisecond
+	defer func() { pollLeaseDuration = old }()
+
+	mbName := "fred"
+	deliverMessage(ds, mbName, "alpha", time.Now())
+
+	mb, err := ds.MailboxFor(mbName)
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msg, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", msg.Subject())
+
+	time.Sleep(20 * time.Millisecond)
+
+	reclaimed, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", reclaimed.Subject())
+}
+
+// A Nack'd message keeps its original id, so a caller tracking messages
+// by ID() doesn't lose track of one across a Nack round trip.
+func TestFSQueueNackPreservesID(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	deliverMessage(ds, "fred", "alpha", time.Now())
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msg, err := fmb.Poll()
+	assert.Nil(t, err)
+	id := msg.ID()
+
+	assert.Nil(t, fmb.Nack(id))
+
+	next, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, id, next.ID())
+}
+
+// A Nack'd message lands back at its original position in GetMessages'
+// Fdate order, not at the tail.
+func TestFSQueueNackPreservesOrder(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	base := time.Now()
+	deliverMessage(ds, "fred", "alpha", base)
+	deliverMessage(ds, "fred", "bravo", base.Add(time.Minute))
+	deliverMessage(ds, "fred", "charlie", base.Add(2*time.Minute))
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msg, err := fmb.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha", msg.Subject())
+
+	assert.Nil(t, fmb.Nack(msg.ID()))
+
+	msgs, err := fmb.GetMessages()
+	assert.Nil(t, err)
+	subjects := make([]string, len(msgs))
+	for i, m := range msgs {
+		subjects[i] = m.Subject()
+	}
+	assert.Equal(t, []string{"alpha", "bravo", "charlie"}, subjects)
+}
+
+// returnInflight is idempotent: if it's asked to redeliver a message
+// that's already indexed (as happens when a crash lands between Poll's
+// writeInflight and Delete calls), it must not duplicate the message in
+// GetMessages.
+func TestFSQueueReturnInflightIdempotent(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	deliverMessage(ds, "fred", "alpha", time.Now())
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msgs, err := fmb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	fm := msgs[0].(*FileMessage)
+
+	r, err := fm.ReadRaw()
+	assert.Nil(t, err)
+	raw, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+
+	// Simulate a crash between Poll's writeInflight and Delete calls: a
+	// lease and inflight copy exist, but the message is also still
+	// indexed, since Delete never ran.
+	deadline := time.Now().Add(time.Minute)
+	assert.Nil(t, fm.mailbox.writeInflight(fm.Fid, fm.Fdate, deadline, raw, nil))
+
+	assert.Nil(t, fmb.returnInflight(fm.Fid))
+
+	msgs, err = fmb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, "alpha", msgs[0].Subject())
+}
+
+// Reaper reclaims an expired lease in the background, without any
+// consumer ever calling Poll again to trigger reclaimExpired inline.
+func TestFSReaperReclaimsExpiredLease(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	oldLease, oldInterval := pollLeaseDuration, reaperInterval
+	pollLeaseDuration = 10 * time.Millisecond
+	reaperInterval = 10 * time.Millisecond
+	defer func() { pollLeaseDuration = oldLease }()
+	defer func() { reaperInterval = oldInterval }()
+
+	mbName := "fred"
+	deliverMessage(ds, mbName, "alpha", time.Now())
+
+	mb, err := ds.MailboxFor(mbName)
+	assert.Nil(t, err)
+	fmb := mb.(*FileMailbox)
+
+	msg, err := fmb.Poll()
+	assert.Nil(t, err)
+	id := msg.ID()
+
+	r := NewReaper(ds)
+	assert.Nil(t, r.Start())
+	defer r.Stop()
+
+	assert.Eventually(t, func() bool {
+		queued, err := fmb.readQueue()
+		return err == nil && len(queued) == 1 && queued[0] == id
+	}, time.Second, 5*time.Millisecond)
+}
+
+// Mailboxes that never call Poll see no change to the ordinary
+// GetMessages/Delete behavior already covered by TestFSDeliverMany and
+// TestFSDelete.
+func TestFSQueueUntouchedWithoutPoll(t *testing.T) {
+	ds, _ := setupDataStore()
+	defer teardownDataStore(ds)
+
+	deliverMessage(ds, "fred", "alpha", time.Now())
+	deliverMessage(ds, "fred", "bravo", time.Now())
+
+	mb, err := ds.MailboxFor("fred")
+	assert.Nil(t, err)
+	msgs, err := mb.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "alpha", msgs[0].Subject())
+	assert.Equal(t, "bravo", msgs[1].Subject())
+}
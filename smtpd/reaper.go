@@ -0,0 +1,80 @@
+package smtpd
+
+import (
+	"log"
+	"time"
+)
+
+// reaperInterval is how often a Reaper wakes up to look for expired
+// leases across every mailbox in its DataStore.
+var reaperInterval = 10 * time.Second
+
+// Reaper periodically reclaims expired leases across every mailbox in a
+// FileDataStore, so a consumer that Polls a message and then crashes or
+// hangs without Ack/Nack-ing it doesn't leave that message stuck in-flight
+// forever. reclaimExpired also runs inline at the top of every Poll, but
+// that only catches expired leases in mailboxes someone happens to be
+// actively polling; an idle mailbox needs a reaper running regardless.
+type Reaper struct {
+	ds   *FileDataStore
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewReaper returns a Reaper over ds. The caller is responsible for
+// calling Start/Stop on the result, the same as it would for the SMTP or
+// POP3 listeners.
+func NewReaper(ds *FileDataStore) *Reaper {
+	return &Reaper{ds: ds}
+}
+
+// Start begins reclaiming expired leases in the background, waking up
+// every reaperInterval.
+func (r *Reaper) Start() error {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run()
+	return nil
+}
+
+// Stop signals the background goroutine to exit and waits for it to do
+// so.
+func (r *Reaper) Stop() error {
+	if r.stop == nil {
+		return nil
+	}
+	close(r.stop)
+	<-r.done
+	return nil
+}
+
+func (r *Reaper) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.reclaimAll()
+		}
+	}
+}
+
+func (r *Reaper) reclaimAll() {
+	mailboxes, err := r.ds.AllQueues()
+	if err != nil {
+		log.Printf("smtpd: reaper listing queues: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, mb := range mailboxes {
+		queueMu.Lock()
+		err := mb.reclaimExpired(now)
+		queueMu.Unlock()
+		if err != nil {
+			log.Printf("smtpd: reaper reclaiming %v: %v", mb.name, err)
+		}
+	}
+}